@@ -3,21 +3,64 @@ package stoppableListener
 // Many thanks to Richard Crowley for writing http://rcrowley.org/articles/golang-graceful-stop.html.
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
 	"net"
-	"os/exec"
-	"runtime"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
+// deadlineListener is the subset of net.Listener implementations which also
+// support SetDeadline, used internally so StoppableListener can wrap any
+// compatible listener type rather than only *net.TCPListener.
+type deadlineListener interface {
+	net.Listener
+	SetDeadline(t time.Time) error
+}
+
+// fileListener is implemented by *net.TCPListener and *net.UnixListener,
+// used internally by Relaunch to obtain the underlying file descriptor.
+type fileListener interface {
+	File() (*os.File, error)
+}
+
+// Environment variables used to pass the inherited listener's file
+// descriptor and parent pid across a Relaunch/Inherit exec.
+const (
+	goAgainFDEnv   = "GOAGAIN_FD"
+	goAgainPPIDEnv = "GOAGAIN_PPID"
+)
+
 type StoppableListener struct {
-	*net.TCPListener                   // Wrapped listener.
-	stopCh               chan struct{} // Channel used only to indicate listener should shutdown.
-	MaxStopChecks        int           // Maximum number of stop checks before StopSafely() gives up and returns an error.
-	StopCheckWaitSeconds int           // Number of seconds to wait for during each stop check.  Must be an integer gte 1, otherwise the resulting behavior is undefined.
-	Verbose              bool          // Activates verbose logging.
+	deadlineListener                    // Wrapped listener.
+	stopMu               sync.Mutex     // Guards stopCh/stopped so concurrent Stop*/Accept* calls are race-free.
+	stopCh               chan struct{}  // Closed exactly once, by Stop, to signal accept loops to exit.
+	stopped              bool           // Set under stopMu when Stop has already run, so repeat calls are no-ops.
+	sem                  chan struct{}  // Semaphore limiting in-flight connections; nil when MaxConcurrent is unset.
+	wg                   sync.WaitGroup // Tracks accepted connections which have not yet been closed.
+	activeConns          int64          // Count of currently open accepted connections; read/written atomically.
+	MaxStopChecks        int            // Maximum number of stop checks before StopSafely() gives up and returns an error.
+	StopCheckWaitSeconds int            // Number of seconds to wait for during each stop check.  Must be an integer gte 1, otherwise the resulting behavior is undefined.
+	MaxConcurrent        int            // Maximum number of simultaneously accepted connections.  0 (the default) means unlimited.  Read only by New, so set it with WithMaxConcurrent; changing it afterwards has no effect.
+	Verbose              bool           // Activates verbose logging.
+}
+
+// Option configures optional StoppableListener behavior at construction time.
+type Option func(*StoppableListener)
+
+// WithMaxConcurrent caps the number of connections Accept will hand out at
+// once; once the cap is reached, Accept blocks until a connection is closed
+// and frees up a slot.
+func WithMaxConcurrent(n int) Option {
+	return func(sl *StoppableListener) {
+		sl.MaxConcurrent = n
+	}
 }
 
 var (
@@ -25,71 +68,248 @@ var (
 	DefaultStopCheckWaitSeconds = 1     // Default number of seconds to wait for during each check.
 	DefaultVerbose              = false // Default value for Verbose field of new StoppableListeners.
 
-	StoppedError              = errors.New("listener stopped")
-	ListenerWrapError         = errors.New("cannot wrap listener")
-	NotStoppedError           = errors.New("listener failed to stop, port is still open after MaxStopChecks exceeded")
-	PlatformNotSupportedError = errors.New("platform not supported")
+	StoppedError      = errors.New("listener stopped")
+	ListenerWrapError = errors.New("cannot wrap listener")
+	NotStoppedError   = errors.New("listener failed to stop, port is still open after MaxStopChecks exceeded")
+	DrainTimeoutError = errors.New("timed out waiting for in-flight connections to finish")
+
+	RelaunchUnsupportedError = errors.New("underlying listener does not support file-descriptor based relaunch")
+	NotInheritingError       = errors.New(goAgainFDEnv + " not set, process was not started via Relaunch")
+
+	errAcceptTimeout = errors.New("accept deadline exceeded, retry") // internal control-flow sentinel, never returned to callers
 )
 
-// New creates a new stoppable TCP listener.
-func New(l net.Listener) (*StoppableListener, error) {
-	tcpL, ok := l.(*net.TCPListener)
+// New creates a new stoppable listener.  *net.TCPListener and
+// *net.UnixListener are supported; anything else is rejected with
+// ListenerWrapError.
+func New(l net.Listener, opts ...Option) (*StoppableListener, error) {
+	dl, ok := l.(deadlineListener)
 
 	if !ok {
 		return nil, ListenerWrapError
 	}
 
+	switch dl.(type) {
+	case *net.TCPListener, *net.UnixListener:
+		// Supported.
+	default:
+		return nil, ListenerWrapError
+	}
+
 	sl := &StoppableListener{
-		TCPListener:          tcpL,
+		deadlineListener:     dl,
 		stopCh:               make(chan struct{}),
 		MaxStopChecks:        DefaultMaxStopChecks,
 		StopCheckWaitSeconds: DefaultStopCheckWaitSeconds,
 		Verbose:              DefaultVerbose,
 	}
 
+	for _, opt := range opts {
+		opt(sl)
+	}
+
+	if sl.MaxConcurrent > 0 {
+		sl.sem = make(chan struct{}, sl.MaxConcurrent)
+	}
+
 	return sl, nil
 }
 
+// Inherit reconstructs a StoppableListener from a file descriptor passed by
+// a parent process via Relaunch, signalling the parent that it may now shut
+// down.  It returns NotInheritingError if GOAGAIN_FD was not set, i.e. this
+// process was started normally rather than via Relaunch.
+func Inherit(opts ...Option) (*StoppableListener, error) {
+	fdStr := os.Getenv(goAgainFDEnv)
+	if fdStr == "" {
+		return nil, NotInheritingError
+	}
+
+	fd, err := strconv.ParseUint(fdStr, 10, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	f := os.NewFile(uintptr(fd), "listener")
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	f.Close()
+
+	if ppidStr := os.Getenv(goAgainPPIDEnv); ppidStr != "" {
+		if ppid, err := strconv.Atoi(ppidStr); err == nil {
+			if p, err := os.FindProcess(ppid); err == nil {
+				p.Signal(syscall.SIGTERM)
+			}
+		}
+	}
+
+	return New(l, opts...)
+}
+
+// trackedConn wraps every net.Conn Accept hands out, releasing its
+// MaxConcurrent semaphore slot (if any) and marking the connection done in
+// sl.wg exactly once when closed.
+type trackedConn struct {
+	net.Conn
+	sl   *StoppableListener
+	once sync.Once
+}
+
+func (c *trackedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(func() {
+		atomic.AddInt64(&c.sl.activeConns, -1)
+		if c.sl.sem != nil {
+			<-c.sl.sem
+		}
+		c.sl.wg.Done()
+	})
+	return err
+}
+
+// acceptOnce performs a single accept attempt against deadline, wrapping a
+// successfully accepted connection for semaphore/WaitGroup tracking.
+// Returns errAcceptTimeout when the deadline was hit without a stop having
+// been requested, signaling the caller to retry.  Semaphore acquisition
+// (when MaxConcurrent is set) honors both ctx and sl.stopCh, closing the
+// freshly accepted connection rather than leaking it if either fires first.
+// wg.Add is gated on stopMu/stopped (the same lock Stop uses) so it can
+// never race with the wg.Wait StopGracefully starts right after Stop
+// returns.
+func (sl *StoppableListener) acceptOnce(ctx context.Context, deadline time.Time) (net.Conn, error) {
+	sl.SetDeadline(deadline)
+
+	newConn, err := sl.deadlineListener.Accept()
+
+	if err != nil {
+		// Check for stop request.
+		select {
+		case <-sl.stopCh:
+			return nil, StoppedError
+		default:
+			// If no stop has been requested proceed with normal operation.
+		}
+
+		// If this is a timeout, then let the caller decide whether to
+		// continue waiting for new connections.
+		if netErr, ok := err.(net.Error); ok {
+			if !netErr.Temporary() {
+				return nil, StoppedError
+			} else if netErr.Timeout() {
+				return nil, errAcceptTimeout
+			}
+		}
+
+		return nil, err
+	}
+
+	if sl.sem != nil {
+		select {
+		case sl.sem <- struct{}{}:
+		case <-sl.stopCh:
+			newConn.Close()
+			return nil, StoppedError
+		case <-ctx.Done():
+			newConn.Close()
+			return nil, ctx.Err()
+		}
+	}
+
+	sl.stopMu.Lock()
+	if sl.stopped {
+		sl.stopMu.Unlock()
+		if sl.sem != nil {
+			<-sl.sem
+		}
+		newConn.Close()
+		return nil, StoppedError
+	}
+	sl.wg.Add(1)
+	sl.stopMu.Unlock()
+
+	atomic.AddInt64(&sl.activeConns, 1)
+	return &trackedConn{Conn: newConn, sl: sl}, nil
+}
+
 func (sl *StoppableListener) Accept() (net.Conn, error) {
 	for {
 		// Wait up to one second for a new connection.
-		sl.SetDeadline(time.Now().Add(time.Second))
-
-		newConn, err := sl.TCPListener.Accept()
+		conn, err := sl.acceptOnce(context.Background(), time.Now().Add(time.Second))
+		if err == errAcceptTimeout {
+			continue
+		}
+		return conn, err
+	}
+}
 
-		if err != nil {
-			// Check for stop request.
+// AcceptContext behaves like Accept, but additionally returns ctx.Err()
+// instead of blocking forever/on the fixed one-second poll once ctx is
+// done.
+func (sl *StoppableListener) AcceptContext(ctx context.Context) (net.Conn, error) {
+	unblock := make(chan struct{})
+	defer close(unblock)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-unblock:
+			return
+		}
+		// ctx is done: keep forcing the deadline into the past so the
+		// accept loop's own future deadline resets can't win the race.
+		for {
 			select {
-			case <-sl.stopCh:
-				close(sl.stopCh)
-				sl.stopCh = nil
-				return nil, StoppedError
+			case <-unblock:
+				return
 			default:
-				// If no stop has been requested proceed with normal operation.
 			}
+			sl.SetDeadline(time.Now())
+			select {
+			case <-unblock:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		default:
+		}
+
+		conn, err := sl.acceptOnce(ctx, time.Now().Add(time.Second))
+		if err == errAcceptTimeout {
+			continue
+		}
 
-			// If this is a timeout, then continue to wait for
-			// new connections.
-			if netErr, ok := err.(net.Error); ok {
-				if !netErr.Temporary() {
-					return nil, StoppedError
-				} else if netErr.Timeout() {
-					continue
-				}
+		if err != nil {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			default:
 			}
 		}
 
-		return newConn, err
+		return conn, err
 	}
 }
 
 func (sl *StoppableListener) Stop() (err error) {
-	if sl.stopCh == nil {
+	sl.stopMu.Lock()
+	if sl.stopped {
+		sl.stopMu.Unlock()
 		return
 	}
+	sl.stopped = true
+	close(sl.stopCh)
+	sl.stopMu.Unlock()
+
 	sl.log("StoppableListener stopping listening")
-	if closeErr := sl.TCPListener.Close(); closeErr != nil {
-		sl.log("StoppableListener non-fatal error closing underyling TCP listener: %s", closeErr)
+	if closeErr := sl.deadlineListener.Close(); closeErr != nil {
+		sl.log("StoppableListener non-fatal error closing underyling listener: %s", closeErr)
 		return
 	}
 	return
@@ -107,25 +327,130 @@ func (sl *StoppableListener) StopSafely() (err error) {
 	return
 }
 
-// waitUntilStopped uses netcat (nc) to determine if the listening port is
-// still accepting connections.  Returns nil when connections are no longer
-// being accepted, or returns NotStoppedError if MaxStopChecks are exceeded.
+// StopWithContext behaves like StopSafely, but drives the stop-probe loop
+// off ctx's deadline/cancellation instead of MaxStopChecks *
+// StopCheckWaitSeconds.
+func (sl *StoppableListener) StopWithContext(ctx context.Context) error {
+	if err := sl.Stop(); err != nil {
+		return err
+	}
+
+	network := sl.dialNetwork()
+	addr := sl.deadlineListener.Addr().String()
+
+	var dialer net.Dialer
+	for {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			sl.log("StopWithContext completed ok")
+			return nil
+		}
+		conn.Close()
+		sl.log("StopWithContext the port is still open")
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(sl.StopCheckWaitSeconds) * time.Second):
+		}
+	}
+}
+
+// StopGracefully stops the listener and waits up to timeout for all
+// currently accepted connections to be closed, returning DrainTimeoutError
+// if they haven't finished in time.
+func (sl *StoppableListener) StopGracefully(timeout time.Duration) error {
+	if err := sl.Stop(); err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		sl.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		return DrainTimeoutError
+	}
+}
+
+// ActiveConnections returns the number of currently open accepted
+// connections.
+func (sl *StoppableListener) ActiveConnections() int {
+	return int(atomic.LoadInt64(&sl.activeConns))
+}
+
+// Relaunch execs a fresh copy of the running binary, passing it the
+// underlying listener's file descriptor so it can pick up serving
+// connections without dropping any, then signal the old process via
+// Inherit.  Combine with StopGracefully to drain the old process's
+// in-flight connections once the new one has taken over.
 //
-// NB: This probably only works on *nix (i.e. NOT Windows).
-func (sl *StoppableListener) waitUntilStopped() error {
-	if runtime.GOOS == "windows" {
-		return PlatformNotSupportedError
+// NB: Like other fd-passing relaunch tricks, this assumes a POSIX-like OS.
+func (sl *StoppableListener) Relaunch() error {
+	fl, ok := sl.deadlineListener.(fileListener)
+	if !ok {
+		return RelaunchUnsupportedError
 	}
-	host, port, _ := net.SplitHostPort(sl.TCPListener.Addr().String())
-	args := append([]string{"-w", fmt.Sprint(sl.StopCheckWaitSeconds)}, host, port)
+
+	f, err := fl.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The child's fd for the inherited listener is determined by its
+	// position in ProcAttr.Files below (index 3), not by f.Fd() in this
+	// (the parent) process.
+	os.Setenv(goAgainFDEnv, "3")
+	os.Setenv(goAgainPPIDEnv, fmt.Sprint(os.Getpid()))
+
+	execPath, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	_, err = os.StartProcess(execPath, os.Args, &os.ProcAttr{
+		Env:   os.Environ(),
+		Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, f},
+	})
+	return err
+}
+
+// dialNetwork returns the dial network ("tcp" or "unix") matching the
+// wrapped listener, for use by the stop-probe dialers.
+func (sl *StoppableListener) dialNetwork() string {
+	if _, ok := sl.deadlineListener.(*net.UnixListener); ok {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// waitUntilStopped determines if the listening address is still accepting
+// connections by dialing it directly.  Returns nil when connections are no
+// longer being accepted, or returns NotStoppedError if MaxStopChecks are
+// exceeded.
+func (sl *StoppableListener) waitUntilStopped() error {
+	network := sl.dialNetwork()
+	addr := sl.deadlineListener.Addr().String()
+	wait := time.Duration(sl.StopCheckWaitSeconds) * time.Second
+
 	for i := 0; i < sl.MaxStopChecks; i++ {
-		err := exec.Command("nc", args...).Run()
-		if err != nil { // If `nc` exits with non-zero status code then that means the port is closed.
+		conn, err := net.DialTimeout(network, addr, wait)
+		if err != nil { // Dial failure means the listener is closed.
 			sl.log("waitUntilStopped completed ok")
 			return nil
 		}
+		conn.Close()
 		sl.log("waitUntilStopped the port is still open")
-		time.Sleep(time.Duration(sl.StopCheckWaitSeconds) * time.Second)
+		time.Sleep(wait)
 	}
 	sl.log("waitUntilStopped max checks exceeded; stop failed")
 	return NotStoppedError
@@ -133,7 +458,7 @@ func (sl *StoppableListener) waitUntilStopped() error {
 
 func (sl *StoppableListener) log(format string, args ...interface{}) {
 	if sl.Verbose {
-		format = fmt.Sprintf("[bind-addr=%v] %v", sl.TCPListener.Addr().String(), format)
+		format = fmt.Sprintf("[bind-addr=%v] %v", sl.deadlineListener.Addr().String(), format)
 		log.Printf(format, args...)
 	}
 }
@@ -1,9 +1,13 @@
 package stoppableListener
 
 import (
+	"context"
 	"net"
+	"os"
+	"path/filepath"
 	"reflect"
 	"runtime"
+	"sync"
 	"testing"
 	"time"
 )
@@ -38,6 +42,322 @@ func TestStopSafely(t *testing.T) {
 	runScenario(t, stoppable, stoppable.StopSafely, true)
 }
 
+// TestConcurrentAcceptStop hammers Accept and Stop from many goroutines at
+// once; run with -race, it catches unsynchronized access to stopCh/stopped,
+// which Stop and acceptOnce guard with stopMu.
+func TestConcurrentAcceptStop(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stoppable, err := New(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := stoppable.Accept()
+			if err == nil {
+				conn.Close()
+			}
+		}()
+	}
+
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stoppable.Stop()
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for concurrent Accept/Stop goroutines to finish")
+	}
+}
+
+// TestAcceptContextCancel verifies that AcceptContext returns ctx.Err()
+// promptly once ctx is canceled, instead of blocking on Accept's fixed
+// one-second poll.
+func TestAcceptContextCancel(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stoppable, err := New(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stoppable.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	result := make(chan error, 1)
+	go func() {
+		_, err := stoppable.AcceptContext(ctx)
+		result <- err
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-result:
+		if err != context.Canceled {
+			t.Errorf("AcceptContext() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(500 * time.Millisecond):
+		t.Fatal("timed out waiting for AcceptContext to return after cancel")
+	}
+}
+
+// TestStopWithContextTimeout verifies that StopWithContext gives up and
+// returns ctx.Err() once its deadline passes, rather than polling forever.
+func TestStopWithContextTimeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stoppable, err := New(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+
+	if err := stoppable.StopWithContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("StopWithContext() error = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+// TestStopUnixListener exercises the *net.UnixListener code path end to
+// end: dialing, accepting, and stopping (with waitUntilStopped's unix dial
+// probe) over a socket in a temp directory, mirroring TestStop/TestStopSafely.
+func TestStopUnixListener(t *testing.T) {
+	sockPath := filepath.Join(t.TempDir(), "stoppable.sock")
+
+	l, err := net.Listen("unix", sockPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stoppable, err := New(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stoppable.Verbose = true
+
+	acceptLoopDone := make(chan struct{})
+	go func() {
+		defer close(acceptLoopDone)
+		for {
+			conn, err := stoppable.Accept()
+			if err != nil {
+				if err == StoppedError {
+					t.Log("Detected listener socket stop, accept loop exiting")
+					return
+				}
+				t.Logf("Error accepting connection: %s", err)
+				continue
+			}
+			go conn.Close()
+		}
+	}()
+
+	if conn, err := net.DialTimeout("unix", sockPath, time.Duration(stoppable.StopCheckWaitSeconds)*time.Second); err != nil {
+		t.Errorf("Unexpected connection failure to unix listener at address=%s: %s", sockPath, err)
+	} else {
+		if err = conn.Close(); err != nil {
+			t.Error(err)
+		}
+	}
+
+	if err := stoppable.StopSafely(); err != nil {
+		t.Errorf("StopSafely() error = %s", err)
+	}
+
+	if conn, err := net.DialTimeout("unix", sockPath, time.Duration(stoppable.StopCheckWaitSeconds)*time.Second); err == nil {
+		conn.Close()
+		t.Error("expected dial to the unix socket to fail after StopSafely, but it succeeded")
+	}
+
+	select {
+	case <-acceptLoopDone:
+	case <-time.After(2 * time.Second):
+		t.Error("timed out waiting for accept loop exit signal after stopping the unix listener")
+	}
+}
+
+// TestInheritNotInheriting verifies that Inherit returns NotInheritingError
+// when GOAGAIN_FD is unset, i.e. the process wasn't started via Relaunch.
+func TestInheritNotInheriting(t *testing.T) {
+	os.Unsetenv("GOAGAIN_FD")
+
+	if _, err := Inherit(); err != NotInheritingError {
+		t.Errorf("Inherit() error = %v, want NotInheritingError", err)
+	}
+}
+
+func TestMaxConcurrent(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stoppable, err := New(l, WithMaxConcurrent(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stoppable.Stop()
+
+	addr := stoppable.Addr().String()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for i := 0; i < 2; i++ {
+			conn, err := stoppable.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	c1, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+
+	var conn1 net.Conn
+	select {
+	case conn1 = <-accepted:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for first Accept with a free MaxConcurrent slot")
+	}
+
+	c2, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+
+	select {
+	case conn2 := <-accepted:
+		conn2.Close()
+		t.Fatal("second Accept returned before the first connection was closed; MaxConcurrent was not enforced")
+	case <-time.After(200 * time.Millisecond):
+		// Expected: Accept is blocked waiting for a free slot.
+	}
+
+	if err := conn1.Close(); err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case conn2 := <-accepted:
+		conn2.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for second Accept after the first connection was closed")
+	}
+}
+
+func TestStopGracefullyDrainsActiveConnections(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stoppable, err := New(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := stoppable.Addr().String()
+
+	serverConns := make(chan net.Conn, 1)
+	go func() {
+		conn, err := stoppable.Accept()
+		if err == nil {
+			serverConns <- conn
+		}
+	}()
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	var serverConn net.Conn
+	select {
+	case serverConn = <-serverConns:
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for Accept")
+	}
+
+	if got := stoppable.ActiveConnections(); got != 1 {
+		t.Errorf("ActiveConnections() = %d, want 1", got)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		serverConn.Close()
+	}()
+
+	if err := stoppable.StopGracefully(2 * time.Second); err != nil {
+		t.Errorf("StopGracefully() error = %s", err)
+	}
+
+	if got := stoppable.ActiveConnections(); got != 0 {
+		t.Errorf("ActiveConnections() after drain = %d, want 0", got)
+	}
+}
+
+func TestStopGracefullyTimesOut(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stoppable, err := New(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addr := stoppable.Addr().String()
+
+	go stoppable.Accept() // Intentionally never closed, to force the drain timeout.
+
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	time.Sleep(50 * time.Millisecond) // Give the accept loop time to register the connection.
+
+	if err := stoppable.StopGracefully(100 * time.Millisecond); err != DrainTimeoutError {
+		t.Errorf("StopGracefully() error = %v, want DrainTimeoutError", err)
+	}
+}
+
 func getFunctionName(i interface{}) string {
 	return runtime.FuncForPC(reflect.ValueOf(i).Pointer()).Name()
 }
@@ -65,13 +385,13 @@ func runScenario(t *testing.T, stoppable *StoppableListener, stopperFunc func()
 		}
 	}()
 
-	addr := stoppable.TCPListener.Addr().String()
+	addr := stoppable.Addr().String()
 
 	if _, _, err := net.SplitHostPort(addr); err != nil {
 		t.Fatalf("Error splitting host:port from address %q: %s", addr, err)
 	}
 
-	if conn, err := net.DialTimeout("tcp", addr, stoppable.StopCheckTimeout); err != nil {
+	if conn, err := net.DialTimeout("tcp", addr, time.Duration(stoppable.StopCheckWaitSeconds)*time.Second); err != nil {
 		t.Errorf("Unexpected connection failure to TCP listener at address=%s: %s", addr, err)
 	} else {
 		if err = conn.Close(); err != nil {
@@ -80,11 +400,11 @@ func runScenario(t *testing.T, stoppable *StoppableListener, stopperFunc func()
 	}
 
 	if err := stopperFunc(); err != nil {
-		t.Errorf("Error: stopperFunc()=%s stopperBlocksUntilDone=%s error=%s", getFunctionName(stopperFunc), stopperBlocksUntilDone, err)
+		t.Errorf("Error: stopperFunc()=%s stopperBlocksUntilDone=%t error=%s", getFunctionName(stopperFunc), stopperBlocksUntilDone, err)
 	}
 
 	if stopperBlocksUntilDone {
-		if conn, err := net.DialTimeout("tcp", addr, stoppable.StopCheckTimeout); err != nil {
+		if conn, err := net.DialTimeout("tcp", addr, time.Duration(stoppable.StopCheckWaitSeconds)*time.Second); err != nil {
 			t.Logf("Received expected connection rejection after %s() to TCP listener at address=%s: %s", getFunctionName(stopperFunc), addr, err)
 		} else {
 			if err = conn.Close(); err != nil {
@@ -97,7 +417,7 @@ func runScenario(t *testing.T, stoppable *StoppableListener, stopperFunc func()
 		}
 	}
 
-	if conn, err := net.DialTimeout("tcp", addr, stoppable.StopCheckTimeout); err != nil {
+	if conn, err := net.DialTimeout("tcp", addr, time.Duration(stoppable.StopCheckWaitSeconds)*time.Second); err != nil {
 		t.Logf("Received expected connection rejection after %s() to TCP listener at address=%s: %s", getFunctionName(stopperFunc), addr, err)
 	} else {
 		if err = conn.Close(); err != nil {